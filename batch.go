@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/wswsmao/keytest/keygen"
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestEntry is one key to generate and import from a --manifest file.
+// Type and Epoch are optional per-entry overrides of the command's --type
+// flag and of epoch-pinned (rather than fresh) generation, respectively.
+type ManifestEntry struct {
+	Name  string
+	Type  string
+	Epoch *uint64
+}
+
+// manifestEntryFields mirrors ManifestEntry for JSON/YAML object entries.
+type manifestEntryFields struct {
+	Name  string  `json:"name" yaml:"name"`
+	Type  string  `json:"type,omitempty" yaml:"type,omitempty"`
+	Epoch *uint64 `json:"epoch,omitempty" yaml:"epoch,omitempty"`
+}
+
+// UnmarshalJSON accepts either a bare name string or a {name,type,epoch} object.
+func (e *ManifestEntry) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*e = ManifestEntry{Name: name}
+		return nil
+	}
+
+	var fields manifestEntryFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*e = ManifestEntry{Name: fields.Name, Type: fields.Type, Epoch: fields.Epoch}
+	return nil
+}
+
+// UnmarshalYAML accepts either a bare name string or a {name,type,epoch} mapping.
+func (e *ManifestEntry) UnmarshalYAML(value *yaml.Node) error {
+	var name string
+	if err := value.Decode(&name); err == nil {
+		*e = ManifestEntry{Name: name}
+		return nil
+	}
+
+	var fields manifestEntryFields
+	if err := value.Decode(&fields); err != nil {
+		return err
+	}
+	*e = ManifestEntry{Name: fields.Name, Type: fields.Type, Epoch: fields.Epoch}
+	return nil
+}
+
+// loadManifest reads a --manifest file. Files named *.json or *.yaml/*.yml
+// are parsed as a list of entries (each either a bare name or a
+// {name,type,epoch} object); anything else is treated as one name per
+// line, ignoring blank lines and "#"-prefixed comments.
+func loadManifest(path string) ([]ManifestEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		var entries []ManifestEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON manifest: %v", err)
+		}
+		return entries, nil
+
+	case ".yaml", ".yml":
+		var entries []ManifestEntry
+		if err := yaml.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse YAML manifest: %v", err)
+		}
+		return entries, nil
+
+	default:
+		var entries []ManifestEntry
+		scanner := bufio.NewScanner(strings.NewReader(string(data)))
+		for scanner.Scan() {
+			name := strings.TrimSpace(scanner.Text())
+			if name == "" || strings.HasPrefix(name, "#") {
+				continue
+			}
+			entries = append(entries, ManifestEntry{Name: name})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read manifest: %v", err)
+		}
+		return entries, nil
+	}
+}
+
+// BatchResult is one line of --manifest mode's newline-delimited JSON
+// output.
+type BatchResult struct {
+	Name   string `json:"name"`
+	KeyID  string `json:"keyID,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// processEntry generates and imports the key for one manifest entry,
+// reporting whether it was freshly imported or already present under that
+// name with a matching ID.
+func processEntry(importer KeyImporter, defaultType keygen.KeyType, e ManifestEntry) BatchResult {
+	keyType := defaultType
+	if e.Type != "" {
+		parsed, err := keygen.ParseKeyType(e.Type)
+		if err != nil {
+			return BatchResult{Name: e.Name, Status: "error", Error: err.Error()}
+		}
+		keyType = parsed
+	}
+
+	var gen *keygen.DetKeyGen
+	var err error
+	if e.Epoch != nil {
+		gen, err = keygen.NewKeyGenAtEpoch(e.Name, *e.Epoch, keyType)
+	} else {
+		gen, err = keygen.NewKeyGen(e.Name, keyType)
+	}
+	if err != nil {
+		return BatchResult{Name: e.Name, Status: "error", Error: fmt.Sprintf("failed to generate key: %v", err)}
+	}
+
+	existed, err := importer.Exists(e.Name)
+	if err != nil {
+		return BatchResult{Name: e.Name, KeyID: gen.GetKeyID(), Status: "error", Error: err.Error()}
+	}
+
+	service := NewKeyService(gen, importer, nil)
+	if err := service.GenerateAndImportKey(e.Name); err != nil {
+		return BatchResult{Name: e.Name, KeyID: gen.GetKeyID(), Status: "error", Error: err.Error()}
+	}
+
+	status := "imported"
+	if existed {
+		status = "exists"
+	}
+	return BatchResult{Name: e.Name, KeyID: gen.GetKeyID(), Status: status}
+}
+
+// runBatch fans entries out across a bounded pool of concurrency workers,
+// streaming each result as NDJSON to stdout as it completes. SIGINT stops
+// the queue from handing out further entries but lets whatever's already
+// in flight finish; unless continueOnError is set, the first error result
+// does the same. It returns true if any entry failed.
+func runBatch(entries []ManifestEntry, importer KeyImporter, defaultType keygen.KeyType, concurrency int, continueOnError bool) bool {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	queueCtx, stopQueue := context.WithCancel(ctx)
+	defer stopQueue()
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	jobs := make(chan ManifestEntry)
+	results := make(chan BatchResult)
+
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for e := range jobs {
+				results <- processEntry(importer, defaultType, e)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, e := range entries {
+			select {
+			case <-queueCtx.Done():
+				return
+			case jobs <- e:
+			}
+		}
+	}()
+
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	enc := json.NewEncoder(os.Stdout)
+	hadError := false
+	for r := range results {
+		if err := enc.Encode(r); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write result for %q: %v\n", r.Name, err)
+		}
+		if r.Status == "error" {
+			hadError = true
+			if !continueOnError {
+				stopQueue()
+			}
+		}
+	}
+
+	// queueCtx is canceled either because an error stopped the queue early
+	// or because SIGINT did; either way, entries that never got dispatched
+	// went unreported, so that counts as a failed run even if every entry
+	// that *did* run succeeded.
+	if queueCtx.Err() != nil {
+		hadError = true
+	}
+
+	return hadError
+}
@@ -0,0 +1,479 @@
+// Package keygen derives deterministic cryptographic keys from name-seeded
+// randomness, for any of the algorithms IPFS's key/import endpoint accepts.
+package keygen
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multibase"
+)
+
+// KeyType identifies the cryptographic algorithm a DetKeyGen should
+// deterministically derive.
+type KeyType int
+
+const (
+	KeyTypeEd25519 KeyType = iota
+	KeyTypeRSA2048
+	KeyTypeRSA3072
+	KeyTypeECDSAP256
+	KeyTypeSecp256k1
+)
+
+// secp256k1CurveOID is the SEC1/ASN.1 object identifier for the secp256k1
+// curve (also used by OpenSSL under the name "secp256k1").
+var secp256k1CurveOID = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+
+func (t KeyType) String() string {
+	switch t {
+	case KeyTypeEd25519:
+		return "ed25519"
+	case KeyTypeRSA2048:
+		return "rsa-2048"
+	case KeyTypeRSA3072:
+		return "rsa-3072"
+	case KeyTypeECDSAP256:
+		return "ecdsa-p256"
+	case KeyTypeSecp256k1:
+		return "secp256k1"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseKeyType maps a `--type` flag value onto a KeyType.
+func ParseKeyType(s string) (KeyType, error) {
+	switch strings.ToLower(s) {
+	case "", "ed25519":
+		return KeyTypeEd25519, nil
+	case "rsa-2048", "rsa2048":
+		return KeyTypeRSA2048, nil
+	case "rsa-3072", "rsa3072":
+		return KeyTypeRSA3072, nil
+	case "ecdsa-p256", "ecdsa", "ecdsap256":
+		return KeyTypeECDSAP256, nil
+	case "secp256k1":
+		return KeyTypeSecp256k1, nil
+	default:
+		return 0, fmt.Errorf("unsupported key type %q", s)
+	}
+}
+
+// DetKeyGen deterministically derives a single key pair for a given name
+// (and, via NewKeyGenAtEpoch, a given rotation) and holds onto its PEM
+// encoding, libp2p peer ID, and a stdlib crypto.Signer for downstream
+// consumers like the signer package.
+type DetKeyGen struct {
+	keyID   string
+	keyData []byte
+	keyType KeyType
+	signer  stdcrypto.Signer
+}
+
+type detRand struct {
+	data   []byte
+	offset int
+}
+
+func newRand(seed string) *detRand {
+	hasher := sha256.New()
+	hasher.Write([]byte(seed))
+	initial := hasher.Sum(nil)
+
+	data := make([]byte, 8192)
+	copy(data, initial)
+
+	for i := 32; i < len(data); i += 32 {
+		hasher.Reset()
+		hasher.Write(data[i-32 : i])
+		copy(data[i:i+32], hasher.Sum(nil))
+	}
+
+	return &detRand{
+		data:   data,
+		offset: 0,
+	}
+}
+
+func (r *detRand) Read(p []byte) (n int, err error) {
+	if r.offset >= len(r.data) {
+		hasher := sha256.New()
+		hasher.Write(r.data)
+		copy(r.data[:32], hasher.Sum(nil))
+
+		for i := 32; i < len(r.data); i += 32 {
+			hasher.Reset()
+			hasher.Write(r.data[i-32 : i])
+			copy(r.data[i:i+32], hasher.Sum(nil))
+		}
+
+		r.offset = 0
+	}
+
+	n = copy(p, r.data[r.offset:])
+	r.offset += n
+	return n, nil
+}
+
+func NewKeyGen(name string, keyType KeyType) (*DetKeyGen, error) {
+	return newKeyGenFromSeed(name, keyType)
+}
+
+// NewKeyGenAtEpoch derives the keyType key for the epoch'th rotation of
+// name. Seeding with "name\x00epoch" keeps every epoch's key independent of
+// the others while remaining fully reproducible from (name, epoch, keyType).
+func NewKeyGenAtEpoch(name string, epoch uint64, keyType KeyType) (*DetKeyGen, error) {
+	seed := fmt.Sprintf("%s\x00%d", name, epoch)
+	return newKeyGenFromSeed(seed, keyType)
+}
+
+func newKeyGenFromSeed(seed string, keyType KeyType) (*DetKeyGen, error) {
+	g := &DetKeyGen{keyType: keyType}
+	err := g.generateKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *DetKeyGen) GetKeyID() string {
+	return g.keyID
+}
+
+func (g *DetKeyGen) GetKeyData() []byte {
+	return g.keyData
+}
+
+func (g *DetKeyGen) GetKeyType() KeyType {
+	return g.keyType
+}
+
+// Signer returns a stdlib crypto.Signer wrapping the generated private key,
+// for consumers (like the signer package) that want to sign with it
+// directly instead of re-parsing the PEM. secp256k1 keys have no stdlib
+// crypto.Signer implementation, so they return an error here.
+func (g *DetKeyGen) Signer() (stdcrypto.Signer, error) {
+	if g.signer == nil {
+		return nil, fmt.Errorf("keygen: %s keys don't support crypto.Signer", g.keyType)
+	}
+	return g.signer, nil
+}
+
+func (g *DetKeyGen) generateKey(name string) error {
+	reader := newRand(name)
+
+	switch g.keyType {
+	case KeyTypeEd25519:
+		return g.generateEd25519(reader)
+	case KeyTypeRSA2048:
+		return g.generateRSA(reader, 2048)
+	case KeyTypeRSA3072:
+		return g.generateRSA(reader, 3072)
+	case KeyTypeECDSAP256:
+		return g.generateECDSAP256(reader)
+	case KeyTypeSecp256k1:
+		return g.generateSecp256k1(reader)
+	default:
+		return fmt.Errorf("unsupported key type: %v", g.keyType)
+	}
+}
+
+func (g *DetKeyGen) generateEd25519(reader *detRand) error {
+	seedBytes := make([]byte, 32)
+	_, err := reader.Read(seedBytes)
+	if err != nil {
+		return fmt.Errorf("failed to generate seed: %v", err)
+	}
+
+	privateKey := ed25519.NewKeyFromSeed(seedBytes)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+
+	libp2pPubKey, err := crypto.UnmarshalEd25519PublicKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to convert to libp2p public key: %v", err)
+	}
+
+	if err := g.setKeyID(libp2pPubKey); err != nil {
+		return err
+	}
+	g.signer = privateKey
+
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to convert key format: %v", err)
+	}
+
+	return g.setPEMKeyData("PRIVATE KEY", privateKeyBytes)
+}
+
+// generateRSA derives an RSA key straight from reader using our own prime
+// search (generateDeterministicRSAKey) rather than crypto/rsa.GenerateKey:
+// the stdlib generator deliberately mixes in a byte from the
+// non-deterministic global math/rand/v2 source (crypto/internal/randutil.
+// MaybeReadByte) specifically to stop callers from depending on a
+// reproducible random stream, which is exactly what deterministic key
+// generation needs here.
+func (g *DetKeyGen) generateRSA(reader *detRand, bits int) error {
+	stdPriv, err := generateDeterministicRSAKey(bits, reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate RSA key: %v", err)
+	}
+
+	if err := g.setKeyIDFromStdKey(stdPriv); err != nil {
+		return err
+	}
+	g.signer = stdPriv
+
+	return g.setPEMKeyData("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(stdPriv))
+}
+
+// generateECDSAP256 derives a P-256 key straight from reader for the same
+// reason generateRSA avoids crypto/ecdsa.GenerateKey: that function also
+// calls randutil.MaybeReadByte and is not reproducible across runs.
+func (g *DetKeyGen) generateECDSAP256(reader *detRand) error {
+	stdPriv, err := generateDeterministicECDSAKey(elliptic.P256(), reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate ECDSA key: %v", err)
+	}
+
+	if err := g.setKeyIDFromStdKey(stdPriv); err != nil {
+		return err
+	}
+	g.signer = stdPriv
+
+	ecBytes, err := x509.MarshalECPrivateKey(stdPriv)
+	if err != nil {
+		return fmt.Errorf("failed to convert key format: %v", err)
+	}
+
+	return g.setPEMKeyData("EC PRIVATE KEY", ecBytes)
+}
+
+// setKeyIDFromStdKey wraps a standard library private key back into its
+// libp2p form just far enough to derive the public key for setKeyID.
+func (g *DetKeyGen) setKeyIDFromStdKey(stdPriv any) error {
+	_, pubKey, err := crypto.KeyPairFromStdKey(stdPriv)
+	if err != nil {
+		return fmt.Errorf("failed to convert to libp2p key: %v", err)
+	}
+	return g.setKeyID(pubKey)
+}
+
+// generateDeterministicRSAKey mirrors crypto/rsa.GenerateKey's algorithm
+// (search for two probable primes of bits/2 length, combine into an RSA-2
+// key with the standard e=65537) but draws every byte of randomness from
+// src and nothing else, so the same src yields the same key every time.
+func generateDeterministicRSAKey(bits int, src io.Reader) (*rsa.PrivateKey, error) {
+	const e = 65537
+	one := big.NewInt(1)
+	bigE := big.NewInt(e)
+
+	for {
+		p, err := deterministicPrime(src, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := deterministicPrime(src, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+		if p.Cmp(q) < 0 {
+			p, q = q, p
+		}
+
+		pMinus1 := new(big.Int).Sub(p, one)
+		qMinus1 := new(big.Int).Sub(q, one)
+		phi := new(big.Int).Mul(pMinus1, qMinus1)
+
+		if new(big.Int).GCD(nil, nil, bigE, phi).Cmp(one) != 0 {
+			continue
+		}
+
+		n := new(big.Int).Mul(p, q)
+		if n.BitLen() != bits {
+			continue
+		}
+
+		priv := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: e},
+			D:         new(big.Int).ModInverse(bigE, phi),
+			Primes:    []*big.Int{p, q},
+		}
+		priv.Precompute()
+		return priv, nil
+	}
+}
+
+// deterministicPrime is crypto/rand.Prime without the randutil.MaybeReadByte
+// call that makes the stdlib version non-reproducible.
+func deterministicPrime(src io.Reader, bits int) (*big.Int, error) {
+	if bits < 2 {
+		return nil, fmt.Errorf("prime size must be at least 2 bits")
+	}
+
+	b := uint(bits % 8)
+	if b == 0 {
+		b = 8
+	}
+
+	bytes := make([]byte, (bits+7)/8)
+	p := new(big.Int)
+
+	for {
+		if _, err := io.ReadFull(src, bytes); err != nil {
+			return nil, err
+		}
+
+		bytes[0] &= uint8(int(1<<b) - 1)
+		if b >= 2 {
+			bytes[0] |= 3 << (b - 2)
+		} else {
+			bytes[0] |= 1
+			if len(bytes) > 1 {
+				bytes[1] |= 0x80
+			}
+		}
+		bytes[len(bytes)-1] |= 1
+
+		p.SetBytes(bytes)
+		if p.ProbablyPrime(20) {
+			return p, nil
+		}
+	}
+}
+
+// generateDeterministicECDSAKey draws a scalar from src by rejection
+// sampling (retrying on the negligible chance it lands at zero or outside
+// the curve's order) instead of calling crypto/ecdsa.GenerateKey, which
+// mixes in non-reproducible randomness the same way rsa.GenerateKey does.
+func generateDeterministicECDSAKey(curve elliptic.Curve, src io.Reader) (*ecdsa.PrivateKey, error) {
+	n := curve.Params().N
+	byteLen := (n.BitLen() + 7) / 8
+
+	for {
+		buf := make([]byte, byteLen)
+		if _, err := io.ReadFull(src, buf); err != nil {
+			return nil, err
+		}
+
+		d := new(big.Int).SetBytes(buf)
+		if d.Sign() == 0 || d.Cmp(n) >= 0 {
+			continue
+		}
+
+		priv := new(ecdsa.PrivateKey)
+		priv.PublicKey.Curve = curve
+		priv.D = d
+		priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+		return priv, nil
+	}
+}
+
+// generateSecp256k1 derives a secp256k1 key directly from the deterministic
+// seed instead of going through crypto.GenerateKeyPairWithReader: that path's
+// secp256k1 branch (crypto.GenerateSecp256k1Key) ignores the supplied reader
+// and always pulls from crypto/rand, which would make the key non-deterministic.
+func (g *DetKeyGen) generateSecp256k1(reader *detRand) error {
+	seedBytes := make([]byte, 32)
+	_, err := reader.Read(seedBytes)
+	if err != nil {
+		return fmt.Errorf("failed to generate seed: %v", err)
+	}
+
+	privKey, err := crypto.UnmarshalSecp256k1PrivateKey(seedBytes)
+	if err != nil {
+		return fmt.Errorf("failed to derive secp256k1 key: %v", err)
+	}
+
+	if err := g.setKeyID(privKey.GetPublic()); err != nil {
+		return err
+	}
+
+	secBytes, err := marshalSecp256k1SEC1(privKey)
+	if err != nil {
+		return fmt.Errorf("failed to convert key format: %v", err)
+	}
+
+	return g.setPEMKeyData("EC PRIVATE KEY", secBytes)
+}
+
+// sec1PrivateKey mirrors the RFC 5915 structure that x509.MarshalECPrivateKey
+// produces for the curves it supports; crypto/x509 doesn't know about
+// secp256k1, so it's built by hand here.
+type sec1PrivateKey struct {
+	Version       int
+	PrivateKey    []byte
+	NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
+}
+
+func marshalSecp256k1SEC1(privKey crypto.PrivKey) ([]byte, error) {
+	raw, err := privKey.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	pubRaw, err := privKey.GetPublic().Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(sec1PrivateKey{
+		Version:       1,
+		PrivateKey:    raw,
+		NamedCurveOID: secp256k1CurveOID,
+		PublicKey:     asn1.BitString{Bytes: pubRaw, BitLength: len(pubRaw) * 8},
+	})
+}
+
+// setKeyID derives the libp2p peer ID (Base36 CIDv1) for pubKey. Keys whose
+// marshaled public key exceeds the 42-byte inline threshold (RSA, ECDSA
+// P-256) end up SHA-256 multihashed; the smaller ones (Ed25519, secp256k1)
+// stay identity-encoded. Both cases are handled by peer.IDFromPublicKey
+// itself.
+func (g *DetKeyGen) setKeyID(pubKey crypto.PubKey) error {
+	peerID, err := peer.IDFromPublicKey(pubKey)
+	if err != nil {
+		return fmt.Errorf("failed to generate peer ID: %v", err)
+	}
+
+	cidStr, err := peer.ToCid(peerID).StringOfBase(multibase.Base36)
+	if err != nil {
+		return fmt.Errorf("failed to convert to CIDv1: %v", err)
+	}
+
+	g.keyID = cidStr
+	return nil
+}
+
+func (g *DetKeyGen) setPEMKeyData(blockType string, der []byte) error {
+	var pemBuf bytes.Buffer
+	err := pem.Encode(&pemBuf, &pem.Block{
+		Type:  blockType,
+		Bytes: der,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to generate PEM data: %v", err)
+	}
+
+	g.keyData = pemBuf.Bytes()
+	return nil
+}
@@ -0,0 +1,238 @@
+package keygen
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+var allKeyTypes = []KeyType{
+	KeyTypeEd25519,
+	KeyTypeRSA2048,
+	KeyTypeRSA3072,
+	KeyTypeECDSAP256,
+	KeyTypeSecp256k1,
+}
+
+// TestDeterministic confirms the same (name, type) always derives the same
+// key ID and key material, across independent DetKeyGen instances.
+func TestDeterministic(t *testing.T) {
+	for _, kt := range allKeyTypes {
+		t.Run(kt.String(), func(t *testing.T) {
+			a, err := NewKeyGen("alice", kt)
+			if err != nil {
+				t.Fatalf("first generation: %v", err)
+			}
+			b, err := NewKeyGen("alice", kt)
+			if err != nil {
+				t.Fatalf("second generation: %v", err)
+			}
+
+			if a.GetKeyID() != b.GetKeyID() {
+				t.Errorf("key ID differs across runs: %q vs %q", a.GetKeyID(), b.GetKeyID())
+			}
+			if string(a.GetKeyData()) != string(b.GetKeyData()) {
+				t.Errorf("key data differs across runs")
+			}
+		})
+	}
+}
+
+// TestEpochsDiffer confirms NewKeyGenAtEpoch derives an independent key for
+// every epoch, and that a bare NewKeyGen doesn't collide with any of them.
+func TestEpochsDiffer(t *testing.T) {
+	for _, kt := range allKeyTypes {
+		t.Run(kt.String(), func(t *testing.T) {
+			epoch0, err := NewKeyGen("bob", kt)
+			if err != nil {
+				t.Fatalf("NewKeyGen: %v", err)
+			}
+			epoch1, err := NewKeyGenAtEpoch("bob", 1, kt)
+			if err != nil {
+				t.Fatalf("NewKeyGenAtEpoch(1): %v", err)
+			}
+			epoch2, err := NewKeyGenAtEpoch("bob", 2, kt)
+			if err != nil {
+				t.Fatalf("NewKeyGenAtEpoch(2): %v", err)
+			}
+
+			ids := map[string]string{
+				"epoch0": epoch0.GetKeyID(),
+				"epoch1": epoch1.GetKeyID(),
+				"epoch2": epoch2.GetKeyID(),
+			}
+			seen := map[string]string{}
+			for label, id := range ids {
+				if other, ok := seen[id]; ok {
+					t.Errorf("%s and %s produced the same key ID %q", label, other, id)
+				}
+				seen[id] = label
+			}
+
+			// NewKeyGenAtEpoch(name, 1, ...) must also reproduce deterministically.
+			epoch1Again, err := NewKeyGenAtEpoch("bob", 1, kt)
+			if err != nil {
+				t.Fatalf("NewKeyGenAtEpoch(1) again: %v", err)
+			}
+			if epoch1Again.GetKeyID() != epoch1.GetKeyID() {
+				t.Errorf("epoch 1 is not reproducible: %q vs %q", epoch1Again.GetKeyID(), epoch1.GetKeyID())
+			}
+		})
+	}
+}
+
+// TestPEMRoundTrip confirms each key type's PEM-encoded private key parses
+// back with the stdlib decoder matching its PEM block type (or, for
+// secp256k1, with the hand-rolled SEC1 ASN.1 structure), and that the
+// decoded key's public half is internally consistent.
+func TestPEMRoundTrip(t *testing.T) {
+	for _, kt := range allKeyTypes {
+		t.Run(kt.String(), func(t *testing.T) {
+			g, err := NewKeyGen("carol", kt)
+			if err != nil {
+				t.Fatalf("NewKeyGen: %v", err)
+			}
+
+			block, rest := pem.Decode(g.GetKeyData())
+			if block == nil {
+				t.Fatalf("PEM data did not decode to a block")
+			}
+			if len(rest) != 0 {
+				t.Errorf("unexpected trailing data after PEM block: %d bytes", len(rest))
+			}
+
+			switch kt {
+			case KeyTypeEd25519:
+				if block.Type != "PRIVATE KEY" {
+					t.Fatalf("unexpected PEM block type %q", block.Type)
+				}
+				key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+				if err != nil {
+					t.Fatalf("ParsePKCS8PrivateKey: %v", err)
+				}
+				priv, ok := key.(ed25519.PrivateKey)
+				if !ok {
+					t.Fatalf("parsed key is %T, not ed25519.PrivateKey", key)
+				}
+				if !priv.Public().(ed25519.PublicKey).Equal(priv.Public()) {
+					t.Fatalf("public key does not match itself")
+				}
+
+			case KeyTypeRSA2048, KeyTypeRSA3072:
+				if block.Type != "RSA PRIVATE KEY" {
+					t.Fatalf("unexpected PEM block type %q", block.Type)
+				}
+				priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+				if err != nil {
+					t.Fatalf("ParsePKCS1PrivateKey: %v", err)
+				}
+				wantBits := 2048
+				if kt == KeyTypeRSA3072 {
+					wantBits = 3072
+				}
+				if priv.N.BitLen() != wantBits {
+					t.Errorf("key has %d bits, want %d", priv.N.BitLen(), wantBits)
+				}
+				if err := priv.Validate(); err != nil {
+					t.Errorf("RSA key fails Validate: %v", err)
+				}
+
+			case KeyTypeECDSAP256:
+				if block.Type != "EC PRIVATE KEY" {
+					t.Fatalf("unexpected PEM block type %q", block.Type)
+				}
+				priv, err := x509.ParseECPrivateKey(block.Bytes)
+				if err != nil {
+					t.Fatalf("ParseECPrivateKey: %v", err)
+				}
+				wantX, wantY := priv.Curve.ScalarBaseMult(priv.D.Bytes())
+				if priv.X.Cmp(wantX) != 0 || priv.Y.Cmp(wantY) != 0 {
+					t.Errorf("public key does not match D on the curve")
+				}
+
+			case KeyTypeSecp256k1:
+				if block.Type != "EC PRIVATE KEY" {
+					t.Fatalf("unexpected PEM block type %q", block.Type)
+				}
+				var parsed sec1PrivateKey
+				if _, err := asn1.Unmarshal(block.Bytes, &parsed); err != nil {
+					t.Fatalf("failed to parse SEC1 structure: %v", err)
+				}
+				if !parsed.NamedCurveOID.Equal(secp256k1CurveOID) {
+					t.Errorf("curve OID %v does not match secp256k1 OID %v", parsed.NamedCurveOID, secp256k1CurveOID)
+				}
+				if len(parsed.PrivateKey) != 32 {
+					t.Errorf("private key is %d bytes, want 32", len(parsed.PrivateKey))
+				}
+			}
+		})
+	}
+}
+
+// TestKeyIDEncoding confirms setKeyID's claim that key types whose
+// marshaled public key serializes past libp2p's 42-byte inline threshold
+// (RSA, ECDSA P-256) end up SHA-256-multihashed, while the small
+// fixed-size ones (Ed25519, secp256k1) stay identity-encoded.
+func TestKeyIDEncoding(t *testing.T) {
+	cases := []struct {
+		kt       KeyType
+		wantCode uint64
+	}{
+		{KeyTypeEd25519, mh.IDENTITY},
+		{KeyTypeRSA2048, mh.SHA2_256},
+		{KeyTypeRSA3072, mh.SHA2_256},
+		// P-256's marshaled public key, like RSA's, is well past libp2p's
+		// 42-byte inline threshold, so it's multihashed too; only the
+		// small fixed-size Ed25519/secp256k1 keys stay identity-encoded.
+		{KeyTypeECDSAP256, mh.SHA2_256},
+		{KeyTypeSecp256k1, mh.IDENTITY},
+	}
+
+	for _, c := range cases {
+		t.Run(c.kt.String(), func(t *testing.T) {
+			g, err := NewKeyGen("dave", c.kt)
+			if err != nil {
+				t.Fatalf("NewKeyGen: %v", err)
+			}
+
+			decoded, err := cid.Decode(g.GetKeyID())
+			if err != nil {
+				t.Fatalf("failed to decode key ID %q as a CID: %v", g.GetKeyID(), err)
+			}
+
+			dmh, err := mh.Decode(decoded.Hash())
+			if err != nil {
+				t.Fatalf("failed to decode multihash: %v", err)
+			}
+
+			if dmh.Code != c.wantCode {
+				t.Errorf("key ID uses multihash code %#x, want %#x", dmh.Code, c.wantCode)
+			}
+		})
+	}
+}
+
+// TestRSAPrimesAreOdd is a narrow regression check on deterministicPrime:
+// every prime it returns must be odd and the right bit length, the two
+// invariants the search loop relies on to terminate.
+func TestRSAPrimesAreOdd(t *testing.T) {
+	reader := newRand("prime-check")
+	p, err := deterministicPrime(reader, 1024)
+	if err != nil {
+		t.Fatalf("deterministicPrime: %v", err)
+	}
+	if p.BitLen() != 1024 {
+		t.Errorf("prime has %d bits, want 1024", p.BitLen())
+	}
+	if p.Bit(0) != 1 {
+		t.Errorf("prime is even")
+	}
+	if !p.ProbablyPrime(20) {
+		t.Errorf("deterministicPrime returned a composite number")
+	}
+}
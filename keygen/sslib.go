@@ -0,0 +1,154 @@
+package keygen
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+)
+
+// SSLibKey is a securesystemslib-compatible key envelope, as used by in-toto
+// and TUF. Private is always empty: DetKeyGen only ever exports public keys
+// this way, since the private key already has its own PEM encoding.
+type SSLibKey struct {
+	KeyID   string      `json:"keyid"`
+	KeyType string      `json:"keytype"`
+	Scheme  string      `json:"scheme"`
+	KeyVal  SSLibKeyVal `json:"keyval"`
+}
+
+// SSLibKeyVal is the "keyval" field of an SSLibKey.
+type SSLibKeyVal struct {
+	Public  string `json:"public"`
+	Private string `json:"private"`
+}
+
+// Export encodes g's public key in the given format. The only format
+// currently supported is "sslib-json", the securesystemslib key envelope
+// used by in-toto/TUF tooling.
+func (g *DetKeyGen) Export(format string) ([]byte, error) {
+	if format != "sslib-json" {
+		return nil, fmt.Errorf("keygen: unsupported export format %q", format)
+	}
+
+	keytype, scheme, err := sslibKeyTypeAndScheme(g.keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := g.Signer()
+	if err != nil {
+		return nil, fmt.Errorf("keygen: cannot export %s key: %v", g.keyType, err)
+	}
+
+	public, err := sslibPublicField(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	keyid, err := sslibKeyID(keytype, scheme, public)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(SSLibKey{
+		KeyID:   keyid,
+		KeyType: keytype,
+		Scheme:  scheme,
+		KeyVal:  SSLibKeyVal{Public: public, Private: ""},
+	})
+}
+
+// LoadFromSSLibBytes parses a securesystemslib key envelope and recomputes
+// its keyid from keytype/scheme/keyval to verify the envelope hasn't been
+// tampered with or mistranscribed.
+func LoadFromSSLibBytes(data []byte) (*SSLibKey, error) {
+	var key SSLibKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("keygen: failed to parse sslib key: %v", err)
+	}
+
+	wantKeyID, err := sslibKeyID(key.KeyType, key.Scheme, key.KeyVal.Public)
+	if err != nil {
+		return nil, err
+	}
+	if wantKeyID != key.KeyID {
+		return nil, fmt.Errorf("keygen: sslib key integrity check failed: keyid %q does not match computed %q", key.KeyID, wantKeyID)
+	}
+
+	return &key, nil
+}
+
+// sslibKeyID computes a securesystemslib keyid: the SHA-256 hex digest of
+// the canonical JSON encoding of the key with its private field emptied
+// and its keyid field absent.
+func sslibKeyID(keytype, scheme, public string) (string, error) {
+	canon, err := canonicalJSON(map[string]any{
+		"keytype": keytype,
+		"scheme":  scheme,
+		"keyval": map[string]any{
+			"public":  public,
+			"private": "",
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("keygen: failed to canonicalize sslib key: %v", err)
+	}
+
+	sum := sha256.Sum256(canon)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// canonicalJSON renders v with sorted object keys, no insignificant
+// whitespace, and no HTML escaping beyond what JSON requires. encoding/json
+// already sorts map[string]any keys and omits insignificant whitespace; it
+// only needs HTML escaping turned off to stop "<", ">", and "&" from being
+// escaped unnecessarily.
+func canonicalJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// sslibKeyTypeAndScheme maps a KeyType onto securesystemslib's keytype and
+// scheme names. secp256k1 has no securesystemslib equivalent, so it's left
+// unsupported.
+func sslibKeyTypeAndScheme(t KeyType) (keytype, scheme string, err error) {
+	switch t {
+	case KeyTypeEd25519:
+		return "ed25519", "ed25519", nil
+	case KeyTypeRSA2048, KeyTypeRSA3072:
+		return "rsa", "rsassa-pss-sha256", nil
+	case KeyTypeECDSAP256:
+		return "ecdsa", "ecdsa-sha2-nistp256", nil
+	default:
+		return "", "", fmt.Errorf("keygen: %s keys have no securesystemslib equivalent", t)
+	}
+}
+
+// sslibPublicField encodes pub the way securesystemslib does: raw hex for
+// Ed25519, PEM-wrapped SubjectPublicKeyInfo for RSA and ECDSA.
+func sslibPublicField(pub any) (string, error) {
+	switch p := pub.(type) {
+	case ed25519.PublicKey:
+		return hex.EncodeToString(p), nil
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(p)
+		if err != nil {
+			return "", fmt.Errorf("keygen: failed to marshal public key: %v", err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+	default:
+		return "", fmt.Errorf("keygen: unsupported public key type %T", pub)
+	}
+}
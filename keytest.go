@@ -2,237 +2,496 @@ package main
 
 import (
 	"bytes"
-	"crypto/ed25519"
-	"crypto/sha256"
-	"crypto/x509"
-	"encoding/pem"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 
-	"github.com/libp2p/go-libp2p/core/crypto"
-	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/multiformats/go-multibase"
+	"github.com/wswsmao/keytest/keygen"
 )
 
 type KeyGenerator interface {
 	GetKeyData() []byte
+	GetKeyType() keygen.KeyType
+	GetKeyID() string
 }
 
 type KeyImporter interface {
-	ImportKey(name string, keyData []byte) error
+	ImportKey(name string, keyData []byte, keyType keygen.KeyType, keyID string) error
+	List() ([]KeyListEntry, error)
+	Rename(oldName, newName string) error
+	Remove(name string) error
+	Exists(name string) (bool, error)
 }
 
-type DetKeyGen struct {
-	keyID   string
-	keyData []byte
+// KeyListEntry is one entry of the IPFS keystore, as returned by
+// `/api/v0/key/list?l=true`.
+type KeyListEntry struct {
+	Name string
+	Id   string
 }
 
-type detRand struct {
-	data   []byte
-	offset int
+// ErrKeyIDConflict is returned by ImportKey when a key already exists under
+// the requested name but with a different ID, so the caller can decide
+// whether to rename-and-replace it.
+type ErrKeyIDConflict struct {
+	Name       string
+	ExpectedID string
+	ActualID   string
 }
 
-func newRand(seed string) *detRand {
-	hasher := sha256.New()
-	hasher.Write([]byte(seed))
-	initial := hasher.Sum(nil)
+func (e *ErrKeyIDConflict) Error() string {
+	return fmt.Sprintf("key %q already exists with id %s, expected %s", e.Name, e.ActualID, e.ExpectedID)
+}
 
-	data := make([]byte, 8192)
-	copy(data, initial)
+type IPFSKeyImporter struct {
+	APIEndpoint string
+	httpClient  *http.Client
+}
 
-	for i := 32; i < len(data); i += 32 {
-		hasher.Reset()
-		hasher.Write(data[i-32 : i])
-		copy(data[i:i+32], hasher.Sum(nil))
+// NewIPFSKeyImporter builds an importer with its own connection-pooling
+// HTTP client, sized generously enough that --manifest's worker pool isn't
+// bottlenecked on establishing a fresh connection per request.
+func NewIPFSKeyImporter(endpoint string) *IPFSKeyImporter {
+	return &IPFSKeyImporter{
+		APIEndpoint: endpoint,
+		httpClient: &http.Client{
+			Transport: &http.Transport{MaxIdleConnsPerHost: 64},
+		},
 	}
+}
 
-	return &detRand{
-		data:   data,
-		offset: 0,
+// pemFormatArg maps a keygen.KeyType onto the `format=` argument IPFS's
+// `key/import` expects for that PEM encoding.
+func pemFormatArg(keyType keygen.KeyType) string {
+	switch keyType {
+	case keygen.KeyTypeRSA2048, keygen.KeyTypeRSA3072:
+		return "pem-pkcs1-cleartext"
+	case keygen.KeyTypeECDSAP256, keygen.KeyTypeSecp256k1:
+		return "pem-sec1-cleartext"
+	default:
+		return "pem-pkcs8-cleartext"
 	}
 }
 
-func (r *detRand) Read(p []byte) (n int, err error) {
-	if r.offset >= len(r.data) {
-		hasher := sha256.New()
-		hasher.Write(r.data)
-		newData := hasher.Sum(nil)
-		copy(r.data, newData)
-		r.offset = 0
+// ImportKey imports keyData under name. If name already exists in the
+// keystore, the import is treated as idempotent: if the existing entry's ID
+// already matches keyID, ImportKey returns success without making further
+// changes; if it matches a different key, ImportKey returns *ErrKeyIDConflict
+// so the caller can decide whether to rename-and-replace.
+func (i *IPFSKeyImporter) ImportKey(name string, keyData []byte, keyType keygen.KeyType, keyID string) error {
+	err := i.doImport(name, keyData, keyType)
+	if err == nil {
+		return nil
+	}
+	if !isKeyExistsError(err) {
+		return err
 	}
 
-	n = copy(p, r.data[r.offset:])
-	r.offset += n
-	return n, nil
+	existingID, found, lookupErr := i.lookupKeyID(name)
+	if lookupErr != nil {
+		return fmt.Errorf("failed to resolve existing key %q after import conflict: %v", name, lookupErr)
+	}
+	if !found {
+		return err
+	}
+	if existingID == keyID {
+		return nil
+	}
+	return &ErrKeyIDConflict{Name: name, ExpectedID: keyID, ActualID: existingID}
 }
 
-func NewKeyGen(name string) (*DetKeyGen, error) {
-	g := &DetKeyGen{}
-	err := g.generateKey(name)
+func (i *IPFSKeyImporter) doImport(name string, keyData []byte, keyType keygen.KeyType) error {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	safeFilename := strings.ReplaceAll(name, "/", "_")
+	safeFilename = strings.ReplaceAll(safeFilename, ":", "_")
+
+	part, err := writer.CreateFormFile("file", safeFilename+".pem")
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to create form file: %v", err)
+	}
+
+	_, err = part.Write(keyData)
+	if err != nil {
+		return fmt.Errorf("failed to write key data: %v", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close multipart writer: %v", err)
+	}
+
+	encodedKeyname := url.QueryEscape(name)
+	reqURL := fmt.Sprintf("%s/api/v0/key/import?arg=%s&format=%s", i.APIEndpoint, encodedKeyname, pemFormatArg(keyType))
+
+	req, err := http.NewRequest("POST", reqURL, body)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %v", err)
 	}
-	return g, nil
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	_, err = i.do(req)
+	return err
 }
 
-func (g *DetKeyGen) GetKeyID() string {
-	return g.keyID
+// isKeyExistsError reports whether err is the IPFS API's response to trying
+// to import a name that's already taken.
+func isKeyExistsError(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "already exists")
 }
 
-func (g *DetKeyGen) GetKeyData() []byte {
-	return g.keyData
+// lookupKeyID returns the ID currently stored under name, if any.
+func (i *IPFSKeyImporter) lookupKeyID(name string) (id string, found bool, err error) {
+	entries, err := i.List()
+	if err != nil {
+		return "", false, err
+	}
+	for _, e := range entries {
+		if e.Name == name {
+			return e.Id, true, nil
+		}
+	}
+	return "", false, nil
 }
 
-func (g *DetKeyGen) generateKey(name string) error {
-	reader := newRand(name)
+// List returns every key currently in the IPFS keystore.
+func (i *IPFSKeyImporter) List() ([]KeyListEntry, error) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v0/key/list?l=true", i.APIEndpoint), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
+	}
 
-	seedBytes := make([]byte, 32)
-	_, err := reader.Read(seedBytes)
+	respBody, err := i.do(req)
 	if err != nil {
-		return fmt.Errorf("failed to generate seed: %v", err)
+		return nil, err
 	}
 
-	privateKey := ed25519.NewKeyFromSeed(seedBytes)
-	publicKey := privateKey.Public().(ed25519.PublicKey)
+	var listResp struct {
+		Keys []KeyListEntry
+	}
+	if err := json.Unmarshal(respBody, &listResp); err != nil {
+		return nil, fmt.Errorf("failed to parse key list: %v", err)
+	}
 
-	libp2pPubKey, err := crypto.UnmarshalEd25519PublicKey(publicKey)
+	return listResp.Keys, nil
+}
+
+// Exists reports whether name is currently present in the IPFS keystore.
+func (i *IPFSKeyImporter) Exists(name string) (bool, error) {
+	_, found, err := i.lookupKeyID(name)
 	if err != nil {
-		return fmt.Errorf("failed to convert to libp2p public key: %v", err)
+		return false, err
 	}
+	return found, nil
+}
 
-	peerID, err := peer.IDFromPublicKey(libp2pPubKey)
+// Rename renames a keystore entry from oldName to newName.
+func (i *IPFSKeyImporter) Rename(oldName, newName string) error {
+	reqURL := fmt.Sprintf("%s/api/v0/key/rename?arg=%s&arg=%s", i.APIEndpoint, url.QueryEscape(oldName), url.QueryEscape(newName))
+	req, err := http.NewRequest("POST", reqURL, nil)
 	if err != nil {
-		return fmt.Errorf("failed to generate peer ID: %v", err)
+		return fmt.Errorf("failed to create HTTP request: %v", err)
 	}
 
-	cidStr, err := peer.ToCid(peerID).StringOfBase(multibase.Base36)
+	_, err = i.do(req)
+	return err
+}
+
+// Remove deletes name from the IPFS keystore.
+func (i *IPFSKeyImporter) Remove(name string) error {
+	reqURL := fmt.Sprintf("%s/api/v0/key/rm?arg=%s", i.APIEndpoint, url.QueryEscape(name))
+	req, err := http.NewRequest("POST", reqURL, nil)
 	if err != nil {
-		return fmt.Errorf("failed to convert to CIDv1: %v", err)
+		return fmt.Errorf("failed to create HTTP request: %v", err)
 	}
 
-	g.keyID = cidStr
+	_, err = i.do(req)
+	return err
+}
 
-	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+// do sends req and returns the response body, treating any non-200 status
+// as an error.
+func (i *IPFSKeyImporter) do(req *http.Request) ([]byte, error) {
+	resp, err := i.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to convert key format: %v", err)
+		return nil, fmt.Errorf("failed to send request: %v", err)
 	}
+	defer resp.Body.Close()
 
-	var pemBuf bytes.Buffer
-	err = pem.Encode(&pemBuf, &pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: privateKeyBytes,
-	})
+	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to generate PEM data: %v", err)
+		return nil, fmt.Errorf("failed to read response body: %v", err)
 	}
 
-	g.keyData = pemBuf.Bytes()
-	return nil
-}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("IPFS API returned error status: %d, body: %s\nRequest URL: %s", resp.StatusCode, string(respBody), req.URL)
+	}
 
-type IPFSKeyImporter struct {
-	APIEndpoint string
+	return respBody, nil
 }
 
-func NewIPFSKeyImporter(endpoint string) *IPFSKeyImporter {
-	return &IPFSKeyImporter{
-		APIEndpoint: endpoint,
-	}
+// KeyHistoryEntry records one rotation of a logical key name.
+type KeyHistoryEntry struct {
+	Epoch     uint64    `json:"epoch"`
+	KeyID     string    `json:"keyID"`
+	CreatedAt time.Time `json:"createdAt"`
 }
 
-func (i *IPFSKeyImporter) ImportKey(name string, keyData []byte) error {
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+// KeyHistory persists the rotation history of every logical key name to a
+// small JSON file, keyed by name, so KeyService.Rotate knows which epoch to
+// derive next.
+type KeyHistory struct {
+	Path string
+}
 
-	safeFilename := strings.ReplaceAll(name, "/", "_")
-	safeFilename = strings.ReplaceAll(safeFilename, ":", "_")
+func NewKeyHistory(path string) *KeyHistory {
+	return &KeyHistory{Path: path}
+}
 
-	part, err := writer.CreateFormFile("file", safeFilename+".pem")
+// defaultHistoryPath places the history file next to the running binary.
+func defaultHistoryPath() string {
+	exe, err := os.Executable()
 	if err != nil {
-		return fmt.Errorf("failed to create form file: %v", err)
+		return "keytest-history.json"
 	}
+	return filepath.Join(filepath.Dir(exe), "keytest-history.json")
+}
 
-	_, err = part.Write(keyData)
-	if err != nil {
-		return fmt.Errorf("failed to write key data: %v", err)
+func (h *KeyHistory) load() (map[string][]KeyHistoryEntry, error) {
+	data, err := os.ReadFile(h.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string][]KeyHistoryEntry{}, nil
 	}
-
-	err = writer.Close()
 	if err != nil {
-		return fmt.Errorf("failed to close multipart writer: %v", err)
+		return nil, fmt.Errorf("failed to read key history file: %v", err)
 	}
 
-	encodedKeyname := url.QueryEscape(name)
-	url := fmt.Sprintf("%s/api/v0/key/import?arg=%s&format=pem-pkcs8-cleartext", i.APIEndpoint, encodedKeyname)
+	all := map[string][]KeyHistoryEntry{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("failed to parse key history file: %v", err)
+	}
+	return all, nil
+}
 
-	req, err := http.NewRequest("POST", url, body)
+// Latest returns the most recent rotation recorded for name, if any.
+func (h *KeyHistory) Latest(name string) (entry KeyHistoryEntry, found bool, err error) {
+	all, err := h.load()
 	if err != nil {
-		return fmt.Errorf("failed to create HTTP request: %v", err)
+		return KeyHistoryEntry{}, false, err
 	}
 
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	entries := all[name]
+	if len(entries) == 0 {
+		return KeyHistoryEntry{}, false, nil
+	}
+	return entries[len(entries)-1], true, nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// Append records a new rotation for name.
+func (h *KeyHistory) Append(name string, entry KeyHistoryEntry) error {
+	all, err := h.load()
 	if err != nil {
-		return fmt.Errorf("failed to send request: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
+	all[name] = append(all[name], entry)
+
+	data, err := json.MarshalIndent(all, "", "  ")
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %v", err)
+		return fmt.Errorf("failed to encode key history: %v", err)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("IPFS API returned error status: %d, body: %s\nRequest URL: %s", resp.StatusCode, string(respBody), url)
+	if err := os.WriteFile(h.Path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write key history file: %v", err)
 	}
-
 	return nil
 }
 
 type KeyService struct {
 	generator KeyGenerator
 	importer  KeyImporter
+	history   *KeyHistory
 }
 
-func NewKeyService(generator KeyGenerator, importer KeyImporter) *KeyService {
+func NewKeyService(generator KeyGenerator, importer KeyImporter, history *KeyHistory) *KeyService {
 	return &KeyService{
 		generator: generator,
 		importer:  importer,
+		history:   history,
 	}
 }
 
 func (s *KeyService) GenerateAndImportKey(name string) error {
 	keyData := s.generator.GetKeyData()
-	err := s.importer.ImportKey(name, keyData)
+	err := s.importer.ImportKey(name, keyData, s.generator.GetKeyType(), s.generator.GetKeyID())
 	if err != nil {
-		return fmt.Errorf("failed to import key: %v", err)
+		return fmt.Errorf("failed to import key: %w", err)
+	}
+
+	if err := s.Verify(name); err != nil {
+		return fmt.Errorf("import succeeded but verification failed: %w", err)
 	}
 
 	return nil
 }
 
+// Verify confirms that name is present in the IPFS keystore with the ID
+// GenerateAndImportKey expects it to have.
+func (s *KeyService) Verify(name string) error {
+	entries, err := s.importer.List()
+	if err != nil {
+		return fmt.Errorf("failed to list keys: %v", err)
+	}
+
+	for _, e := range entries {
+		if e.Name == name {
+			if e.Id != s.generator.GetKeyID() {
+				return fmt.Errorf("keystore entry %q has id %s, expected %s", name, e.Id, s.generator.GetKeyID())
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no keystore entry named %q found", name)
+}
+
+// Rotate derives the next epoch's key for name and, unless dryRun is set,
+// imports it as name-vN, archives the currently-active key as name-vN-1,
+// and promotes name-vN to name. With dryRun set, it only reports the key ID
+// the rotation would produce, so an operator can pre-publish the new IPNS
+// record before flipping the daemon over. keyType is taken directly rather
+// than read off s.generator, since the only generator Rotate needs is the
+// one it derives itself at the new epoch.
+func (s *KeyService) Rotate(name string, keyType keygen.KeyType, dryRun bool) (*KeyHistoryEntry, error) {
+	latest, found, err := s.history.Latest(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key history: %v", err)
+	}
+
+	nextEpoch := uint64(1)
+	if found {
+		nextEpoch = latest.Epoch + 1
+	}
+
+	newGen, err := keygen.NewKeyGenAtEpoch(name, nextEpoch, keyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate rotated key: %v", err)
+	}
+
+	entry := &KeyHistoryEntry{
+		Epoch:     nextEpoch,
+		KeyID:     newGen.GetKeyID(),
+		CreatedAt: time.Now(),
+	}
+
+	if dryRun {
+		return entry, nil
+	}
+
+	versionedName := fmt.Sprintf("%s-v%d", name, nextEpoch)
+	archivalName := fmt.Sprintf("%s-v%d", name, nextEpoch-1)
+
+	if err := s.importer.ImportKey(versionedName, newGen.GetKeyData(), newGen.GetKeyType(), newGen.GetKeyID()); err != nil {
+		return nil, fmt.Errorf("failed to import rotated key: %v", err)
+	}
+
+	if active, err := s.importer.Exists(name); err != nil {
+		return nil, fmt.Errorf("failed to check for active key %q: %v", name, err)
+	} else if active {
+		if err := s.importer.Rename(name, archivalName); err != nil {
+			return nil, fmt.Errorf("failed to archive current key as %q: %v", archivalName, err)
+		}
+	}
+
+	if err := s.importer.Rename(versionedName, name); err != nil {
+		return nil, fmt.Errorf("failed to promote %q to %q: %v", versionedName, name, err)
+	}
+
+	if err := s.history.Append(name, *entry); err != nil {
+		return nil, fmt.Errorf("failed to record key history: %v", err)
+	}
+
+	return entry, nil
+}
+
+func usage() {
+	fmt.Println("Usage: keytest [--type ed25519|rsa-2048|rsa-3072|ecdsa-p256|secp256k1] [--rotate [--dry-run]] <keyname>")
+	fmt.Println("       keytest --manifest <file> [--concurrency N] [--continue-on-error] [--type T]")
+}
+
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: keytest <keyname>")
+	typeFlag := flag.String("type", "ed25519", "key type to generate: ed25519, rsa-2048, rsa-3072, ecdsa-p256, secp256k1")
+	rotateFlag := flag.Bool("rotate", false, "rotate <keyname> to its next epoch instead of generating it fresh")
+	dryRunFlag := flag.Bool("dry-run", false, "with -rotate, print the resulting key ID without touching the daemon or history")
+	historyFlag := flag.String("history-file", defaultHistoryPath(), "path to the JSON file tracking key rotation history")
+	manifestFlag := flag.String("manifest", "", "path to a manifest (one name per line, or a JSON/YAML list of {name,type,epoch} entries) to generate and import as a batch")
+	concurrencyFlag := flag.Int("concurrency", runtime.NumCPU(), "with --manifest, number of entries to generate and import concurrently")
+	continueOnErrorFlag := flag.Bool("continue-on-error", false, "with --manifest, keep processing remaining entries after one fails instead of stopping the queue")
+	flag.Parse()
+
+	keyType, err := keygen.ParseKeyType(*typeFlag)
+	if err != nil {
+		fmt.Printf("Invalid --type: %v\n", err)
 		os.Exit(1)
 	}
-	keyname := os.Args[1]
 
-	generator, err := NewKeyGen(keyname)
+	importer := NewIPFSKeyImporter("http://127.0.0.1:5001")
+
+	if *manifestFlag != "" {
+		if flag.NArg() != 0 || *rotateFlag || *dryRunFlag {
+			usage()
+			os.Exit(1)
+		}
+
+		entries, err := loadManifest(*manifestFlag)
+		if err != nil {
+			fmt.Printf("Failed to load manifest: %v\n", err)
+			os.Exit(1)
+		}
+
+		if runBatch(entries, importer, keyType, *concurrencyFlag, *continueOnErrorFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(1)
+	}
+	keyname := flag.Arg(0)
+
+	if *rotateFlag {
+		service := NewKeyService(nil, importer, NewKeyHistory(*historyFlag))
+		entry, err := service.Rotate(keyname, keyType, *dryRunFlag)
+		if err != nil {
+			fmt.Printf("Rotation failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%s %s (epoch %d)\n", entry.KeyID, keyname, entry.Epoch)
+		return
+	}
+
+	generator, err := keygen.NewKeyGen(keyname, keyType)
 	if err != nil {
 		fmt.Printf("Failed to create key generator: %v\n", err)
 		os.Exit(1)
 	}
 
-	importer := NewIPFSKeyImporter("http://127.0.0.1:5001")
-	service := NewKeyService(generator, importer)
+	service := NewKeyService(generator, importer, nil)
 
 	err = service.GenerateAndImportKey(keyname)
 	if err != nil {
@@ -0,0 +1,226 @@
+// Package signer reuses a deterministic keygen.DetKeyGen identity to sign
+// compact JWS tokens, with a libtrust-style "kid" derived from the key's
+// SubjectPublicKeyInfo so downstream services can verify tokens without
+// talking to the IPFS daemon.
+package signer
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/wswsmao/keytest/keygen"
+)
+
+// Signer signs JWTs with a deterministic keygen.DetKeyGen identity.
+type Signer struct {
+	key stdcrypto.Signer
+	pub any
+	alg string
+	kid string
+}
+
+// New builds a Signer over gen's key. It fails for key types with no JOSE
+// algorithm mapping (currently secp256k1, which also has no stdlib
+// crypto.Signer implementation to sign with in the first place).
+func New(gen *keygen.DetKeyGen) (*Signer, error) {
+	key, err := gen.Signer()
+	if err != nil {
+		return nil, err
+	}
+
+	pub := key.Public()
+	alg, err := algorithmFor(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := computeKid(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signer{key: key, pub: pub, alg: alg, kid: kid}, nil
+}
+
+// algorithmFor selects the JOSE alg for pub: EdDSA for Ed25519, RS256 for
+// RSA, ES256/ES384 for ECDSA P-256/P-384.
+func algorithmFor(pub stdcrypto.PublicKey) (string, error) {
+	switch p := pub.(type) {
+	case ed25519.PublicKey:
+		return "EdDSA", nil
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		switch p.Curve {
+		case elliptic.P256():
+			return "ES256", nil
+		case elliptic.P384():
+			return "ES384", nil
+		default:
+			return "", fmt.Errorf("signer: unsupported ECDSA curve %s", p.Curve.Params().Name)
+		}
+	default:
+		return "", fmt.Errorf("signer: unsupported key type %T", pub)
+	}
+}
+
+// computeKid is libtrust's key fingerprint: DER-encode the PKIX
+// SubjectPublicKeyInfo, SHA-256 it, truncate to the first 240 bits, and
+// base32-encode (no padding) into 12 groups of 4 characters.
+func computeKid(pub stdcrypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("signer: failed to marshal public key: %v", err)
+	}
+
+	sum := sha256.Sum256(der)
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:30])
+
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, ":"), nil
+}
+
+// Kid returns the signer's libtrust-style key fingerprint.
+func (s *Signer) Kid() string {
+	return s.kid
+}
+
+// SignJWT signs claims as a compact JWS, with a JOSE header carrying alg
+// and the libtrust kid.
+func (s *Signer) SignJWT(claims any) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"typ": "JWT",
+		"alg": s.alg,
+		"kid": s.kid,
+	})
+	if err != nil {
+		return "", fmt.Errorf("signer: failed to encode header: %v", err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("signer: failed to encode claims: %v", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	sig, err := s.sign([]byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("signer: failed to sign token: %v", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (s *Signer) sign(signingInput []byte) ([]byte, error) {
+	switch s.alg {
+	case "EdDSA":
+		return s.key.Sign(rand.Reader, signingInput, stdcrypto.Hash(0))
+	case "RS256":
+		hashed := sha256.Sum256(signingInput)
+		return s.key.Sign(rand.Reader, hashed[:], stdcrypto.SHA256)
+	case "ES256":
+		hashed := sha256.Sum256(signingInput)
+		return s.signECDSA(hashed[:], stdcrypto.SHA256, 32)
+	case "ES384":
+		hashed := sha512.Sum384(signingInput)
+		return s.signECDSA(hashed[:], stdcrypto.SHA384, 48)
+	default:
+		return nil, fmt.Errorf("unsupported alg %s", s.alg)
+	}
+}
+
+// signECDSA signs a digest and converts crypto.Signer's ASN.1 DER output
+// into the fixed-width R||S encoding JWS requires.
+func (s *Signer) signECDSA(digest []byte, hash stdcrypto.Hash, byteLen int) ([]byte, error) {
+	der, err := s.key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse ECDSA signature: %v", err)
+	}
+
+	raw := make([]byte, byteLen*2)
+	parsed.R.FillBytes(raw[:byteLen])
+	parsed.S.FillBytes(raw[byteLen:])
+	return raw, nil
+}
+
+// JWK is a JSON Web Key, populated with only the fields relevant to its Kty.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+
+	// OKP (Ed25519)
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+// PublicJWK returns the JWK for s's public key, carrying the same kid as
+// SignJWT's tokens.
+func (s *Signer) PublicJWK() (*JWK, error) {
+	switch pub := s.pub.(type) {
+	case ed25519.PublicKey:
+		return &JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+			Kid: s.kid,
+			Alg: s.alg,
+		}, nil
+
+	case *rsa.PublicKey:
+		eBytes := big.NewInt(int64(pub.E)).Bytes()
+		return &JWK{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(eBytes),
+			Kid: s.kid,
+			Alg: s.alg,
+		}, nil
+
+	case *ecdsa.PublicKey:
+		byteLen := (pub.Curve.Params().BitSize + 7) / 8
+		x := make([]byte, byteLen)
+		y := make([]byte, byteLen)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		return &JWK{
+			Kty: "EC",
+			Crv: pub.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(x),
+			Y:   base64.RawURLEncoding.EncodeToString(y),
+			Kid: s.kid,
+			Alg: s.alg,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("signer: unsupported key type %T", pub)
+	}
+}